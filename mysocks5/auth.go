@@ -0,0 +1,167 @@
+// This file implements pluggable SOCKS5 authentication. Only the "no
+// authentication required" and username/password (RFC 1929) methods are
+// provided; GSSAPI (RFC 1961) is not implemented. Callers that need
+// GSSAPI can still plug it in by implementing Authenticator themselves
+// and registering it via Config.AuthMethods.
+package mysocks5
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	// NoAuth is the "no authentication required" method (RFC 1928)
+	NoAuth = uint8(0)
+	// UserPassAuth is the username/password method (RFC 1929)
+	UserPassAuth = uint8(2)
+	// noAcceptableAuth is returned when no method offered by the client
+	// is supported by the server
+	noAcceptableAuth = uint8(0xFF)
+	// userPassAuthVersion is the subnegotiation version for RFC 1929
+	userPassAuthVersion = uint8(1)
+	// authSuccess/authFailure are the status bytes of the RFC 1929 reply
+	authSuccess = uint8(0)
+	authFailure = uint8(1)
+)
+
+// errNoAcceptableAuth is returned when none of the client's advertised
+// methods are supported by the server
+var errNoAcceptableAuth = errors.New("mysocks5: no acceptable authentication method")
+
+// errUserPassAuthFailed is returned when the supplied credentials are invalid
+var errUserPassAuthFailed = errors.New("mysocks5: username/password authentication failed")
+
+// AuthContext carries the outcome of a successful authentication so that
+// downstream rules and loggers can see who authenticated and how
+type AuthContext struct {
+	// Method is the authentication method that was used
+	Method uint8
+	// Payload contains method-specific data, e.g. {"Username": "..."}
+	// for UserPassAuthenticator
+	Payload map[string]string
+}
+
+// Authenticator is implemented by each supported SOCKS5 authentication
+// method. Code identifies the method in the method-negotiation byte, and
+// Authenticate runs the method's sub-negotiation once it has been selected.
+type Authenticator interface {
+	// Code returns the method identifier advertised during negotiation
+	Code() uint8
+	// Authenticate runs the sub-negotiation for this method
+	Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error)
+}
+
+// CredentialStore is used to validate username/password credentials
+type CredentialStore interface {
+	Valid(username, password string) bool
+}
+
+// StaticCredentials is a simple CredentialStore backed by a map of
+// username to password, useful for tests and small deployments
+type StaticCredentials map[string]string
+
+func (s StaticCredentials) Valid(username, password string) bool {
+	pass, ok := s[username]
+	return ok && pass == password
+}
+
+// NoAuthAuthenticator is used to handle the "no authentication" mode
+type NoAuthAuthenticator struct{}
+
+func (a NoAuthAuthenticator) Code() uint8 { return NoAuth }
+
+func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	_, err := writer.Write([]byte{socks5Version, NoAuth})
+	return &AuthContext{Method: NoAuth}, err
+}
+
+// UserPassAuthenticator implements the username/password sub-negotiation
+// described in RFC 1929
+type UserPassAuthenticator struct {
+	Credentials CredentialStore
+}
+
+func (a UserPassAuthenticator) Code() uint8 { return UserPassAuth }
+
+func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	if _, err := writer.Write([]byte{socks5Version, UserPassAuth}); err != nil {
+		return nil, err
+	}
+
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != userPassAuthVersion {
+		return nil, errors.New("mysocks5: unsupported username/password version")
+	}
+
+	userLen := int(header[1])
+	user := make([]byte, userLen)
+	if _, err := io.ReadFull(reader, user); err != nil {
+		return nil, err
+	}
+
+	passLen := []byte{0}
+	if _, err := io.ReadFull(reader, passLen); err != nil {
+		return nil, err
+	}
+	pass := make([]byte, int(passLen[0]))
+	if _, err := io.ReadFull(reader, pass); err != nil {
+		return nil, err
+	}
+
+	if a.Credentials == nil || !a.Credentials.Valid(string(user), string(pass)) {
+		writer.Write([]byte{userPassAuthVersion, authFailure})
+		return nil, errUserPassAuthFailed
+	}
+
+	if _, err := writer.Write([]byte{userPassAuthVersion, authSuccess}); err != nil {
+		return nil, err
+	}
+	return &AuthContext{
+		Method:  UserPassAuth,
+		Payload: map[string]string{"Username": string(user)},
+	}, nil
+}
+
+// authenticate reads the client's advertised methods, picks the first
+// one (in configured order) that the server also supports, and runs its
+// sub-negotiation. It replies {0x05, 0xFF} and returns an error if no
+// method is acceptable.
+func (s *Server) authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	header := []byte{0}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	numMethods := int(header[0])
+	methods := make([]byte, numMethods)
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return nil, err
+	}
+
+	for _, authenticator := range s.config.authMethods() {
+		for _, method := range methods {
+			if authenticator.Code() == method {
+				return authenticator.Authenticate(reader, writer)
+			}
+		}
+	}
+
+	writer.Write([]byte{socks5Version, noAcceptableAuth})
+	return nil, errNoAcceptableAuth
+}
+
+// authMethods returns the configured authenticators, defaulting to
+// no-auth (or username/password, if a CredentialStore was supplied)
+// when none were registered explicitly
+func (c *Config) authMethods() []Authenticator {
+	if len(c.AuthMethods) > 0 {
+		return c.AuthMethods
+	}
+	if c.Credentials != nil {
+		return []Authenticator{UserPassAuthenticator{Credentials: c.Credentials}}
+	}
+	return []Authenticator{NoAuthAuthenticator{}}
+}
@@ -0,0 +1,102 @@
+package mysocks5
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUserPassAuthenticatorSuccess(t *testing.T) {
+	creds := StaticCredentials{"alice": "s3cret"}
+	auth := UserPassAuthenticator{Credentials: creds}
+
+	var req bytes.Buffer
+	req.WriteByte(userPassAuthVersion)
+	req.WriteByte(byte(len("alice")))
+	req.WriteString("alice")
+	req.WriteByte(byte(len("s3cret")))
+	req.WriteString("s3cret")
+
+	var resp bytes.Buffer
+	ctx, err := auth.Authenticate(&req, &resp)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ctx.Method != UserPassAuth {
+		t.Errorf("expected method %d, got %d", UserPassAuth, ctx.Method)
+	}
+	if ctx.Payload["Username"] != "alice" {
+		t.Errorf("expected username %q, got %q", "alice", ctx.Payload["Username"])
+	}
+
+	want := []byte{socks5Version, UserPassAuth, userPassAuthVersion, authSuccess}
+	if !bytes.Equal(resp.Bytes(), want) {
+		t.Errorf("unexpected reply bytes: got %v, want %v", resp.Bytes(), want)
+	}
+}
+
+func TestUserPassAuthenticatorFailure(t *testing.T) {
+	creds := StaticCredentials{"alice": "s3cret"}
+	auth := UserPassAuthenticator{Credentials: creds}
+
+	var req bytes.Buffer
+	req.WriteByte(userPassAuthVersion)
+	req.WriteByte(byte(len("alice")))
+	req.WriteString("alice")
+	req.WriteByte(byte(len("wrong")))
+	req.WriteString("wrong")
+
+	var resp bytes.Buffer
+	if _, err := auth.Authenticate(&req, &resp); err != errUserPassAuthFailed {
+		t.Fatalf("expected errUserPassAuthFailed, got %v", err)
+	}
+
+	want := []byte{socks5Version, UserPassAuth, userPassAuthVersion, authFailure}
+	if !bytes.Equal(resp.Bytes(), want) {
+		t.Errorf("unexpected reply bytes: got %v, want %v", resp.Bytes(), want)
+	}
+}
+
+func TestServerAuthenticateSelectsConfiguredMethod(t *testing.T) {
+	s := &Server{config: &Config{
+		AuthMethods: []Authenticator{UserPassAuthenticator{Credentials: StaticCredentials{"bob": "pw"}}},
+	}}
+
+	var req bytes.Buffer
+	req.WriteByte(2) // numMethods
+	req.WriteByte(NoAuth)
+	req.WriteByte(UserPassAuth)
+	req.WriteByte(userPassAuthVersion)
+	req.WriteByte(byte(len("bob")))
+	req.WriteString("bob")
+	req.WriteByte(byte(len("pw")))
+	req.WriteString("pw")
+
+	var resp bytes.Buffer
+	ctx, err := s.authenticate(&req, &resp)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ctx.Method != UserPassAuth {
+		t.Errorf("expected method %d, got %d", UserPassAuth, ctx.Method)
+	}
+}
+
+func TestServerAuthenticateNoAcceptableMethod(t *testing.T) {
+	s := &Server{config: &Config{
+		AuthMethods: []Authenticator{UserPassAuthenticator{Credentials: StaticCredentials{}}},
+	}}
+
+	var req bytes.Buffer
+	req.WriteByte(1) // numMethods
+	req.WriteByte(NoAuth)
+
+	var resp bytes.Buffer
+	if _, err := s.authenticate(&req, &resp); err != errNoAcceptableAuth {
+		t.Fatalf("expected errNoAcceptableAuth, got %v", err)
+	}
+
+	want := []byte{socks5Version, noAcceptableAuth}
+	if !bytes.Equal(resp.Bytes(), want) {
+		t.Errorf("unexpected reply bytes: got %v, want %v", resp.Bytes(), want)
+	}
+}
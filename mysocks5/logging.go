@@ -0,0 +1,35 @@
+package mysocks5
+
+import "log"
+
+// Logger is the logging interface used throughout the package. It lets
+// callers plug in structured/leveled loggers instead of a bare
+// *log.Logger.
+type Logger interface {
+	Errorf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+}
+
+// StdLogger adapts a *log.Logger to the Logger interface, for backward
+// compatibility with callers that configured a plain *log.Logger.
+type StdLogger struct {
+	*log.Logger
+}
+
+// NewStdLogger wraps l as a Logger
+func NewStdLogger(l *log.Logger) *StdLogger {
+	return &StdLogger{Logger: l}
+}
+
+func (l *StdLogger) Errorf(format string, args ...interface{}) {
+	l.Printf("[ERR] socks: "+format, args...)
+}
+
+func (l *StdLogger) Infof(format string, args ...interface{}) {
+	l.Printf("[INFO] socks: "+format, args...)
+}
+
+func (l *StdLogger) Debugf(format string, args ...interface{}) {
+	l.Printf("[DEBUG] socks: "+format, args...)
+}
@@ -2,35 +2,88 @@ package mysocks5
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
+	"sync"
+	"time"
 )
 
 const (
 	socks5Version = uint8(5)
-	noAuth        = uint8(0)
 )
 
 // Config is used to setup and configure a Server
 type Config struct {
 	// BindIP is used for bind or udp associate
 	BindIP net.IP
-	Logger *log.Logger
+	Logger Logger
+
+	// AuthMethods is the list of supported authentication methods, tried
+	// in order against the methods offered by the client. If empty,
+	// defaults to username/password (when Credentials is set) or no-auth.
+	AuthMethods []Authenticator
+	// Credentials is consulted by the default UserPassAuthenticator when
+	// AuthMethods is not set explicitly
+	Credentials CredentialStore
+
+	// Resolver is used to resolve FQDN destinations. Defaults to DNSResolver.
+	Resolver NameResolver
+	// Rules decides whether a request is permitted to proceed. Defaults
+	// to PermitAll.
+	Rules RuleSet
+	// Rewriter optionally rewrites a request's destination address
+	// after resolution. No-op by default.
+	Rewriter AddressRewriter
+
+	// Dial is used to establish outbound connections, letting callers
+	// route egress through a custom dialer. Defaults to a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// GPool, if set, is used to submit connection handlers instead of
+	// spawning an unbounded goroutine per connection.
+	GPool GPool
+
+	// OnConnect, if set, is invoked as soon as a connection is accepted
+	OnConnect func(remote net.Addr)
+	// OnRequest, if set, is invoked once the SOCKS5 request has been
+	// parsed and authenticated
+	OnRequest func(req *Request)
+	// OnDialFailed, if set, is invoked when dialing the destination fails
+	OnDialFailed func(req *Request, err error)
+	// OnClose, if set, is invoked when a connection's proxying finishes
+	OnClose func(req *Request, bytesUp, bytesDown int64, duration time.Duration)
 }
 
 // Server is responsible for accepting connections and handling
 // the details of the SOCKS5 protocol
 type Server struct {
 	config *Config
+
+	// BaseContext, if set, supplies the base context for each connection
+	// served off a given listener, mirroring net/http.Server.BaseContext.
+	BaseContext func(l net.Listener) context.Context
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[net.Conn]struct{}
+	inShutdown bool
+	wg         sync.WaitGroup
+	baseCtx    context.Context
 }
 
 // New creates a new Server and potentially returns an error
 func New(conf *Config) (*Server, error) {
 	if conf.Logger == nil {
-		conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+		conf.Logger = NewStdLogger(log.New(os.Stdout, "", log.LstdFlags))
+	}
+	if conf.Resolver == nil {
+		conf.Resolver = DNSResolver{}
+	}
+	if conf.Rules == nil {
+		conf.Rules = PermitAll{}
 	}
 	server := &Server{
 		config: conf,
@@ -50,36 +103,82 @@ func (s *Server) ListenAndServe(network, addr string) error {
 
 // Serve is used to serve connections from a listener
 func (s *Server) Serve(l net.Listener) error {
+	s.trackListener(l, true)
+	defer s.trackListener(l, false)
+
+	ctx := context.Background()
+	if s.BaseContext != nil {
+		ctx = s.BaseContext(l)
+	}
+	s.mu.Lock()
+	s.baseCtx = ctx
+	s.mu.Unlock()
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
-		go s.ServeConn(conn)
+
+		handler := func() { s.ServeConn(conn) }
+		if s.config.GPool != nil {
+			if err := s.config.GPool.Submit(handler); err != nil {
+				s.config.Logger.Errorf("Failed to submit connection to pool: %v", err)
+				conn.Close()
+			}
+			continue
+		}
+		go handler()
+	}
+}
+
+// getBaseContext returns the context established by the most recent
+// Serve call, or context.Background() if ServeConn is being driven
+// directly without going through Serve.
+func (s *Server) getBaseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.baseCtx != nil {
+		return s.baseCtx
 	}
+	return context.Background()
 }
 
 // ServeConn is used to serve a single connection.
 func (s *Server) ServeConn(conn net.Conn) error {
+	s.wg.Add(1)
+	s.trackConn(conn, true)
+	defer s.wg.Done()
+	defer s.trackConn(conn, false)
 	defer conn.Close()
 	bufConn := bufio.NewReader(conn)
 
+	if s.config.OnConnect != nil {
+		s.config.OnConnect(conn.RemoteAddr())
+	}
+	s.config.Logger.Debugf("accepted connection from %v", conn.RemoteAddr())
+
 	// Read the version byte
 	version := []byte{0}
 	if _, err := bufConn.Read(version); err != nil {
-		s.config.Logger.Printf("[ERR] socks: Failed to get version byte: %v", err)
+		s.config.Logger.Errorf("Failed to get version byte: %v", err)
 		return err
 	}
 	// Ensure we are compatible
 	if version[0] != socks5Version {
 		err := fmt.Errorf("Unsupported SOCKS version: %v", version)
-		s.config.Logger.Printf("[ERR] socks: %v", err)
+		s.config.Logger.Errorf("%v", err)
 		return err
 	}
-	if err := s.needNoAuth(bufConn, conn); err != nil {
-		s.config.Logger.Printf("[ERR] socks: Invalid method region: %v", err)
+	authContext, err := s.authenticate(bufConn, conn)
+	if err != nil {
+		s.config.Logger.Errorf("Failed to authenticate: %v", err)
 		return err
 	}
+	s.config.Logger.Debugf("authenticated %v via method %d", conn.RemoteAddr(), authContext.Method)
 	request, err := NewRequest(bufConn)
 	if err != nil {
 		if err == unrecognizedAddrType {
@@ -89,29 +188,20 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		}
 		return fmt.Errorf("Failed to read destination address: %v", err)
 	}
+	request.AuthContext = authContext
 	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
 		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
 	}
+	if s.config.OnRequest != nil {
+		s.config.OnRequest(request)
+	}
+	s.config.Logger.Infof("request: command=%d dest=%v from=%v", request.Command, request.DestAddr, request.RemoteAddr)
 	// Process the client request
-	if err := s.handleRequest(request, conn); err != nil {
+	if err := s.handleRequest(s.getBaseContext(), request, conn); err != nil {
 		err = fmt.Errorf("Failed to handle request: %v", err)
-		s.config.Logger.Printf("[ERR] socks: %v", err)
+		s.config.Logger.Errorf("%v", err)
 		return err
 	}
+	s.config.Logger.Infof("request complete: dest=%v", request.DestAddr)
 	return nil
 }
-
-// 告诉客户端我们采用无认证的方式连接
-func (s *Server) needNoAuth(r io.Reader, w io.Writer) error {
-	header := []byte{0}
-	if _, err := r.Read(header); err != nil {
-		return err
-	}
-	numMethods := int(header[0])
-	methods := make([]byte, numMethods)
-	if _, err := io.ReadAtLeast(r, methods, numMethods); err != nil {
-		return err
-	}
-	_, err := w.Write([]byte{socks5Version, noAuth})
-	return err
-}
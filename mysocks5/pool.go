@@ -0,0 +1,99 @@
+package mysocks5
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown or Close have been
+// called, mirroring net/http.
+var ErrServerClosed = errors.New("mysocks5: Server closed")
+
+// GPool lets callers cap connection-handling concurrency with an
+// externally managed worker pool (e.g. an ants-style pool) instead of an
+// unbounded goroutine per connection.
+type GPool interface {
+	Submit(task func()) error
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+// closeListenersLocked closes every tracked listener. s.mu must be held.
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, l)
+	}
+	return err
+}
+
+// Shutdown stops the server from accepting new connections, then waits
+// for in-flight connections to finish or for ctx to be done, whichever
+// comes first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	lnErr := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return lnErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the server from accepting new connections and force-closes
+// every tracked in-flight connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inShutdown = true
+	err := s.closeListenersLocked()
+	for c := range s.conns {
+		c.Close()
+		delete(s.conns, c)
+	}
+	return err
+}
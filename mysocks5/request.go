@@ -0,0 +1,520 @@
+package mysocks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ConnectCommand establishes a TCP stream to the destination
+	ConnectCommand = uint8(1)
+	// BindCommand asks the proxy to accept an inbound connection on the
+	// operator's behalf
+	BindCommand = uint8(2)
+	// AssociateCommand establishes a UDP relay for the life of the
+	// accompanying TCP control connection
+	AssociateCommand = uint8(3)
+
+	ipv4Address = uint8(1)
+	fqdnAddress = uint8(3)
+	ipv6Address = uint8(4)
+)
+
+const (
+	successReply uint8 = iota
+	serverFailure
+	ruleFailure
+	networkUnreachable
+	hostUnreachable
+	connectionRefused
+	ttlExpired
+	commandNotSupported
+	addrTypeNotSupported
+)
+
+var unrecognizedAddrType = errors.New("mysocks5: unrecognized address type")
+
+// AddrSpec identifies a destination or bound address, as either an IP or
+// a not-yet-resolved FQDN
+type AddrSpec struct {
+	FQDN string
+	IP   net.IP
+	Port int
+}
+
+func (a *AddrSpec) String() string {
+	if a.FQDN != "" {
+		return fmt.Sprintf("%s (%s):%d", a.FQDN, a.IP, a.Port)
+	}
+	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+}
+
+// Address returns a net.Dial-compatible "host:port" string, preferring
+// the resolved IP when present
+func (a *AddrSpec) Address() string {
+	if a.IP != nil {
+		return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+	}
+	return net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
+}
+
+// Request represents a parsed SOCKS5 request
+type Request struct {
+	// Version is always socks5Version
+	Version uint8
+	// Command is one of ConnectCommand, BindCommand or AssociateCommand
+	Command uint8
+	// AuthContext records how the client authenticated
+	AuthContext *AuthContext
+	// RemoteAddr is the client's address
+	RemoteAddr *AddrSpec
+	// DestAddr is the address as parsed from the request
+	DestAddr *AddrSpec
+	// realDestAddr is DestAddr after resolution and, if configured,
+	// Config.Rewriter has had a chance to rewrite it
+	realDestAddr *AddrSpec
+	// bufConn lets callers continue reading any buffered bytes
+	// (e.g. the remainder of a CONNECT payload) after the header
+	bufConn io.Reader
+}
+
+// NewRequest reads and parses a SOCKS5 request header from bufConn
+func NewRequest(bufConn io.Reader) (*Request, error) {
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadFull(bufConn, header); err != nil {
+		return nil, fmt.Errorf("mysocks5: failed to get request header: %v", err)
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("mysocks5: unsupported command version: %v", header[0])
+	}
+
+	dest, err := readAddrSpec(bufConn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Request{
+		Version:  socks5Version,
+		Command:  header[1],
+		DestAddr: dest,
+		bufConn:  bufConn,
+	}, nil
+}
+
+// readAddrSpec parses an ATYP/address/port triple as used both in the
+// request header and in the UDP relay header
+func readAddrSpec(r io.Reader) (*AddrSpec, error) {
+	d := &AddrSpec{}
+
+	addrType := []byte{0}
+	if _, err := io.ReadFull(r, addrType); err != nil {
+		return nil, err
+	}
+
+	switch addrType[0] {
+	case ipv4Address:
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return nil, err
+		}
+		d.IP = net.IP(addr)
+	case ipv6Address:
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return nil, err
+		}
+		d.IP = net.IP(addr)
+	case fqdnAddress:
+		fqdnLen := []byte{0}
+		if _, err := io.ReadFull(r, fqdnLen); err != nil {
+			return nil, err
+		}
+		fqdn := make([]byte, int(fqdnLen[0]))
+		if _, err := io.ReadFull(r, fqdn); err != nil {
+			return nil, err
+		}
+		d.FQDN = string(fqdn)
+	default:
+		return nil, unrecognizedAddrType
+	}
+
+	port := []byte{0, 0}
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	d.Port = (int(port[0]) << 8) | int(port[1])
+
+	return d, nil
+}
+
+// sendReply writes a SOCKS5 reply with the given status and bound
+// address. addr may be nil, in which case the zero address is sent.
+func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	var addrType uint8
+	var addrBody []byte
+	var addrPort int
+
+	switch {
+	case addr == nil:
+		addrType = ipv4Address
+		addrBody = []byte{0, 0, 0, 0}
+		addrPort = 0
+	case addr.FQDN != "":
+		addrType = fqdnAddress
+		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
+		addrPort = addr.Port
+	case addr.IP.To4() != nil:
+		addrType = ipv4Address
+		addrBody = addr.IP.To4()
+		addrPort = addr.Port
+	case addr.IP.To16() != nil:
+		addrType = ipv6Address
+		addrBody = addr.IP.To16()
+		addrPort = addr.Port
+	default:
+		return fmt.Errorf("mysocks5: failed to format address: %v", addr)
+	}
+
+	msg := make([]byte, 0, 6+len(addrBody))
+	msg = append(msg, socks5Version, resp, 0, addrType)
+	msg = append(msg, addrBody...)
+	msg = append(msg, byte(addrPort>>8), byte(addrPort&0xff))
+
+	_, err := w.Write(msg)
+	return err
+}
+
+// handleRequest resolves and rewrites the request's destination, checks
+// it against the configured RuleSet, and dispatches to the handler for
+// its command. The context produced by each stage is threaded through to
+// the next and on into the command handler.
+func (s *Server) handleRequest(ctx context.Context, req *Request, conn net.Conn) error {
+	if req.DestAddr.FQDN != "" {
+		newCtx, ip, err := s.config.Resolver.Resolve(ctx, req.DestAddr.FQDN)
+		if err != nil {
+			sendReply(conn, hostUnreachable, nil)
+			return fmt.Errorf("mysocks5: failed to resolve %q: %v", req.DestAddr.FQDN, err)
+		}
+		ctx = newCtx
+		req.realDestAddr = &AddrSpec{FQDN: req.DestAddr.FQDN, IP: ip, Port: req.DestAddr.Port}
+	} else {
+		req.realDestAddr = req.DestAddr
+	}
+
+	if s.config.Rewriter != nil {
+		var newDest *AddrSpec
+		ctx, newDest = s.config.Rewriter.Rewrite(ctx, req)
+		if newDest == nil {
+			if err := sendReply(conn, hostUnreachable, nil); err != nil {
+				return fmt.Errorf("mysocks5: failed to send reply: %v", err)
+			}
+			return fmt.Errorf("mysocks5: rewriter rejected destination %v", req.DestAddr)
+		}
+		req.realDestAddr = newDest
+	}
+
+	var allowed bool
+	ctx, allowed = s.config.Rules.Allow(ctx, req)
+	if !allowed {
+		if err := sendReply(conn, ruleFailure, nil); err != nil {
+			return fmt.Errorf("mysocks5: failed to send reply: %v", err)
+		}
+		return fmt.Errorf("mysocks5: command %v denied by rule set", req.Command)
+	}
+
+	switch req.Command {
+	case ConnectCommand:
+		return s.handleConnect(ctx, req, conn)
+	case BindCommand:
+		return s.handleBind(ctx, req, conn)
+	case AssociateCommand:
+		return s.handleAssociate(ctx, req, conn)
+	default:
+		if err := sendReply(conn, commandNotSupported, nil); err != nil {
+			return fmt.Errorf("mysocks5: failed to send reply: %v", err)
+		}
+		return fmt.Errorf("mysocks5: unsupported command: %v", req.Command)
+	}
+}
+
+// dial establishes an outbound connection, using Config.Dial when set
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.config.Dial != nil {
+		return s.config.Dial(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// handleConnect proxies a bidirectional TCP stream to the destination
+func (s *Server) handleConnect(ctx context.Context, req *Request, conn net.Conn) error {
+	target, err := s.dial(ctx, "tcp", req.realDestAddr.Address())
+	if err != nil {
+		s.config.Logger.Debugf("connect to %v failed: %v", req.realDestAddr, err)
+		if s.config.OnDialFailed != nil {
+			s.config.OnDialFailed(req, err)
+		}
+		if err := sendReply(conn, hostUnreachable, nil); err != nil {
+			return fmt.Errorf("mysocks5: failed to send reply: %v", err)
+		}
+		return fmt.Errorf("mysocks5: connect to %v failed: %v", req.DestAddr, err)
+	}
+	defer target.Close()
+
+	local := target.LocalAddr().(*net.TCPAddr)
+	bind := AddrSpec{IP: local.IP, Port: local.Port}
+	if err := sendReply(conn, successReply, &bind); err != nil {
+		return fmt.Errorf("mysocks5: failed to send reply: %v", err)
+	}
+
+	start := time.Now()
+	up, down, perr := proxy(target, conn)
+	dur := time.Since(start)
+	s.config.Logger.Debugf("closed %v: up=%d down=%d duration=%v", req.realDestAddr, up, down, dur)
+	if s.config.OnClose != nil {
+		s.config.OnClose(req, up, down, dur)
+	}
+	return perr
+}
+
+// handleBind opens a listener on Config.BindIP, replies with its address,
+// waits for a single inbound connection, then proxies bidirectionally
+// between that connection and the client per RFC 1928.
+func (s *Server) handleBind(ctx context.Context, req *Request, conn net.Conn) error {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: s.config.BindIP, Port: 0})
+	if err != nil {
+		if err := sendReply(conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("mysocks5: failed to send reply: %v", err)
+		}
+		return fmt.Errorf("mysocks5: failed to open bind listener: %v", err)
+	}
+	// Track this per-request listener the same way the accept listener
+	// is tracked, so Close/Shutdown can reclaim a BIND that never gets
+	// a peer connection instead of leaving Accept blocked forever.
+	s.trackListener(listener, true)
+	defer s.trackListener(listener, false)
+	defer listener.Close()
+
+	bound := listener.Addr().(*net.TCPAddr)
+	if err := sendReply(conn, successReply, &AddrSpec{IP: bound.IP, Port: bound.Port}); err != nil {
+		return fmt.Errorf("mysocks5: failed to send first bind reply: %v", err)
+	}
+
+	peer, err := listener.Accept()
+	if err != nil {
+		sendReply(conn, serverFailure, nil)
+		return fmt.Errorf("mysocks5: failed to accept bound connection: %v", err)
+	}
+	s.trackConn(peer, true)
+	defer s.trackConn(peer, false)
+	defer peer.Close()
+
+	peerAddr := peer.RemoteAddr().(*net.TCPAddr)
+	if err := sendReply(conn, successReply, &AddrSpec{IP: peerAddr.IP, Port: peerAddr.Port}); err != nil {
+		return fmt.Errorf("mysocks5: failed to send second bind reply: %v", err)
+	}
+
+	start := time.Now()
+	up, down, perr := proxy(peer, conn)
+	dur := time.Since(start)
+	s.config.Logger.Debugf("closed bind %v: up=%d down=%d duration=%v", peerAddr, up, down, dur)
+	if s.config.OnClose != nil {
+		s.config.OnClose(req, up, down, dur)
+	}
+	return perr
+}
+
+// handleAssociate opens a UDP socket on Config.BindIP, replies with its
+// address, and relays datagrams between the client and their destinations
+// for as long as the TCP control connection stays open.
+func (s *Server) handleAssociate(ctx context.Context, req *Request, conn net.Conn) error {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: s.config.BindIP, Port: 0})
+	if err != nil {
+		if err := sendReply(conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("mysocks5: failed to send reply: %v", err)
+		}
+		return fmt.Errorf("mysocks5: failed to open udp relay: %v", err)
+	}
+	defer udpConn.Close()
+
+	bound := udpConn.LocalAddr().(*net.UDPAddr)
+	if err := sendReply(conn, successReply, &AddrSpec{IP: bound.IP, Port: bound.Port}); err != nil {
+		return fmt.Errorf("mysocks5: failed to send reply: %v", err)
+	}
+
+	var up, down int64
+	errCh := make(chan error, 1)
+	start := time.Now()
+	go func() { errCh <- s.relayUDP(udpConn, &up, &down) }()
+
+	// The association lives as long as the TCP control connection; keep
+	// draining it and only tear the association down once it actually
+	// closes (a stray byte from the client must not end the association).
+	buf := make([]byte, 1)
+	var ctrlErr error
+	for {
+		if _, ctrlErr = conn.Read(buf); ctrlErr != nil {
+			break
+		}
+	}
+	udpConn.Close()
+	<-errCh
+
+	dur := time.Since(start)
+	s.config.Logger.Debugf("closed udp associate %v: up=%d down=%d duration=%v", bound, up, down, dur)
+	if s.config.OnClose != nil {
+		s.config.OnClose(req, atomic.LoadInt64(&up), atomic.LoadInt64(&down), dur)
+	}
+	return ctrlErr
+}
+
+// buildUDPHeader prepends the SOCKS5 UDP request header
+// (RSV RSV FRAG ATYP DST.ADDR DST.PORT) for dest onto payload
+func buildUDPHeader(dest *AddrSpec, payload []byte) []byte {
+	header := make([]byte, 0, 10+len(payload))
+	header = append(header, 0, 0, 0)
+	if dest.FQDN != "" {
+		header = append(header, fqdnAddress, byte(len(dest.FQDN)))
+		header = append(header, dest.FQDN...)
+	} else if dest.IP.To4() != nil {
+		header = append(header, ipv4Address)
+		header = append(header, dest.IP.To4()...)
+	} else {
+		header = append(header, ipv6Address)
+		header = append(header, dest.IP.To16()...)
+	}
+	header = append(header, byte(dest.Port>>8), byte(dest.Port&0xff))
+	return append(header, payload...)
+}
+
+// relayUDP reads SOCKS5 UDP request datagrams from clientConn and
+// forwards their payload to DST.ADDR:DST.PORT. Each distinct destination
+// gets its own UDP socket with a concurrent read loop that relays replies
+// back through clientConn, so a slow or unresponsive destination can
+// never stall datagrams bound for other destinations. Byte counts are
+// accumulated in up/down.
+func (s *Server) relayUDP(clientConn *net.UDPConn, up, down *int64) error {
+	var mu sync.Mutex
+	sessions := make(map[string]*net.UDPConn)
+	defer func() {
+		mu.Lock()
+		for _, c := range sessions {
+			c.Close()
+		}
+		mu.Unlock()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, clientAddr, err := clientConn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if n < 4 {
+			continue
+		}
+		// RSV RSV FRAG ATYP DST.ADDR DST.PORT DATA
+		if buf[2] != 0 {
+			// fragmented datagrams are not supported
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		dest, err := readAddrSpec(r)
+		if err != nil {
+			continue
+		}
+		// headerLen is the offset into buf where DATA begins: n - r.Len()
+		// already accounts for the 3-byte RSV/RSV/FRAG prefix, since r
+		// wraps buf[3:n].
+		headerLen := n - r.Len()
+		data := buf[headerLen:n]
+		atomic.AddInt64(up, int64(len(data)))
+
+		destKey := dest.Address()
+		mu.Lock()
+		destConn, ok := sessions[destKey]
+		if !ok {
+			destAddr, rerr := net.ResolveUDPAddr("udp", destKey)
+			if rerr != nil {
+				mu.Unlock()
+				continue
+			}
+			destConn, err = net.DialUDP("udp", nil, destAddr)
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
+			sessions[destKey] = destConn
+			go s.relayUDPReplies(destConn, clientConn, clientAddr, dest, down)
+		}
+		mu.Unlock()
+
+		destConn.Write(data)
+	}
+}
+
+// relayUDPReplies reads datagrams coming back from a single destination
+// and relays them to clientAddr through clientConn, wrapped in the same
+// SOCKS5 UDP header, until destConn is closed.
+func (s *Server) relayUDPReplies(destConn, clientConn *net.UDPConn, clientAddr *net.UDPAddr, dest *AddrSpec, down *int64) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := destConn.Read(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(down, int64(n))
+		clientConn.WriteToUDP(buildUDPHeader(dest, buf[:n]), clientAddr)
+	}
+}
+
+// halfCloser is implemented by net.Conn types (e.g. *net.TCPConn) that
+// support closing only the write half of the connection
+type halfCloser interface {
+	CloseWrite() error
+}
+
+type copyResult struct {
+	n   int64
+	err error
+}
+
+// copyHalf copies from src to dst, then half-closes dst (if supported)
+// so the peer sees EOF once its half of the stream is done
+func copyHalf(dst, src net.Conn) <-chan copyResult {
+	ch := make(chan copyResult, 1)
+	go func() {
+		n, err := io.Copy(dst, src)
+		if hc, ok := dst.(halfCloser); ok {
+			hc.CloseWrite()
+		}
+		ch <- copyResult{n: n, err: err}
+	}()
+	return ch
+}
+
+// proxy copies bytes bidirectionally between dst and src until both
+// directions finish, returning the bytes sent from src to dst (up) and
+// from dst to src (down).
+func proxy(dst, src net.Conn) (up, down int64, err error) {
+	upCh := copyHalf(dst, src)
+	downCh := copyHalf(src, dst)
+
+	upResult := <-upCh
+	downResult := <-downCh
+
+	up, down = upResult.n, downResult.n
+	err = upResult.err
+	if err == nil {
+		err = downResult.err
+	}
+	return
+}
@@ -0,0 +1,220 @@
+package mysocks5
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadAddrSpecIPv4(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteByte(ipv4Address)
+	buf.Write(net.IPv4(127, 0, 0, 1).To4())
+	buf.WriteByte(0x1F)
+	buf.WriteByte(0x90) // port 8080
+
+	d, err := readAddrSpec(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !d.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("unexpected IP: %v", d.IP)
+	}
+	if d.Port != 8080 {
+		t.Errorf("expected port 8080, got %d", d.Port)
+	}
+}
+
+func TestReadAddrSpecFQDN(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteByte(fqdnAddress)
+	buf.WriteByte(byte(len("example.com")))
+	buf.WriteString("example.com")
+	buf.WriteByte(0x00)
+	buf.WriteByte(0x50) // port 80
+
+	d, err := readAddrSpec(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.FQDN != "example.com" {
+		t.Errorf("expected FQDN example.com, got %q", d.FQDN)
+	}
+	if d.Port != 80 {
+		t.Errorf("expected port 80, got %d", d.Port)
+	}
+}
+
+func TestReadAddrSpecUnrecognizedType(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{0x09})
+	if _, err := readAddrSpec(buf); err != unrecognizedAddrType {
+		t.Fatalf("expected unrecognizedAddrType, got %v", err)
+	}
+}
+
+func TestBuildUDPHeaderIPv4(t *testing.T) {
+	dest := &AddrSpec{IP: net.IPv4(10, 0, 0, 1), Port: 53}
+	got := buildUDPHeader(dest, []byte("payload"))
+
+	want := []byte{0, 0, 0, ipv4Address, 10, 0, 0, 1, 0, 53}
+	want = append(want, "payload"...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("unexpected header: got %v, want %v", got, want)
+	}
+}
+
+// TestRelayUDPDropsFragmentedDatagrams exercises relayUDP over real
+// loopback sockets and verifies that a datagram with FRAG != 0 is
+// silently dropped rather than relayed to the destination.
+func TestRelayUDPDropsFragmentedDatagrams(t *testing.T) {
+	dest, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to open destination socket: %v", err)
+	}
+	defer dest.Close()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to open client socket: %v", err)
+	}
+
+	s := &Server{}
+	var up, down int64
+	go s.relayUDP(client, &up, &down)
+	defer client.Close()
+
+	destAddr := dest.LocalAddr().(*net.UDPAddr)
+	datagram := buildUDPHeader(&AddrSpec{IP: destAddr.IP, Port: destAddr.Port}, []byte("hello"))
+	datagram[2] = 1 // FRAG != 0: must be dropped
+
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	sender, err := net.DialUDP("udp", nil, clientAddr)
+	if err != nil {
+		t.Fatalf("failed to dial client relay: %v", err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write(datagram); err != nil {
+		t.Fatalf("failed to write datagram: %v", err)
+	}
+
+	dest.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 64)
+	if n, _, err := dest.ReadFromUDP(buf); err == nil {
+		t.Fatalf("expected fragmented datagram to be dropped, got %d bytes", n)
+	}
+}
+
+// TestRelayUDPForwardsPayloadIntact verifies that relayUDP delivers the
+// DATA portion of a non-fragmented datagram to the destination unaltered.
+func TestRelayUDPForwardsPayloadIntact(t *testing.T) {
+	dest, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to open destination socket: %v", err)
+	}
+	defer dest.Close()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to open client socket: %v", err)
+	}
+
+	s := &Server{}
+	var up, down int64
+	go s.relayUDP(client, &up, &down)
+	defer client.Close()
+
+	destAddr := dest.LocalAddr().(*net.UDPAddr)
+	datagram := buildUDPHeader(&AddrSpec{IP: destAddr.IP, Port: destAddr.Port}, []byte("hello"))
+
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	sender, err := net.DialUDP("udp", nil, clientAddr)
+	if err != nil {
+		t.Fatalf("failed to dial client relay: %v", err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write(datagram); err != nil {
+		t.Fatalf("failed to write datagram: %v", err)
+	}
+
+	dest.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	n, _, err := dest.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("destination never received the datagram: %v", err)
+	}
+	if got := string(buf[:n]); got != "hello" {
+		t.Fatalf("expected payload %q, got %q", "hello", got)
+	}
+}
+
+// nilRewriter is an AddressRewriter that always vetoes the request.
+type nilRewriter struct{}
+
+func (nilRewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec) {
+	return ctx, nil
+}
+
+// TestHandleRequestNilRewriteDoesNotPanic guards against a nil
+// *AddrSpec returned from AddressRewriter.Rewrite being dereferenced
+// further down the pipeline instead of being treated as a veto.
+func TestHandleRequestNilRewriteDoesNotPanic(t *testing.T) {
+	s := &Server{config: &Config{
+		Resolver: DNSResolver{},
+		Rules:    PermitAll{},
+		Rewriter: nilRewriter{},
+	}}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	req := &Request{Command: ConnectCommand, DestAddr: &AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 80}}
+
+	done := make(chan error, 1)
+	go func() { done <- s.handleRequest(context.Background(), req, server) }()
+
+	reply := make([]byte, 10)
+	if _, err := client.Read(reply); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if reply[1] != hostUnreachable {
+		t.Errorf("expected hostUnreachable reply, got %d", reply[1])
+	}
+	if err := <-done; err == nil {
+		t.Error("expected handleRequest to return an error for a vetoed rewrite")
+	}
+}
+
+// TestRelayUDPZeroLengthPayloadDoesNotPanic guards against the slicing
+// bug where a datagram with no DATA (or a DATA shorter than the header
+// reconstruction assumed) caused buf[3+headerLen:n] to panic with a
+// slice-bounds-out-of-range error.
+func TestRelayUDPZeroLengthPayloadDoesNotPanic(t *testing.T) {
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to open client socket: %v", err)
+	}
+
+	s := &Server{}
+	var up, down int64
+	go s.relayUDP(client, &up, &down)
+	defer client.Close()
+
+	datagram := buildUDPHeader(&AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 9}, nil)
+
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	sender, err := net.DialUDP("udp", nil, clientAddr)
+	if err != nil {
+		t.Fatalf("failed to dial client relay: %v", err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write(datagram); err != nil {
+		t.Fatalf("failed to write datagram: %v", err)
+	}
+
+	// Give relayUDP's goroutine a chance to process the datagram; if it
+	// panics, the test binary crashes and this test fails loudly.
+	time.Sleep(100 * time.Millisecond)
+}
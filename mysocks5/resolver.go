@@ -0,0 +1,28 @@
+package mysocks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// NameResolver is used to resolve FQDN destinations to an IP before a
+// connection is dialed. Implementations may stash resolver-specific state
+// (e.g. a trace span) on the returned context.
+type NameResolver interface {
+	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
+}
+
+// DNSResolver is the default NameResolver, backed by net.DefaultResolver
+type DNSResolver struct{}
+
+func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if len(addrs) == 0 {
+		return ctx, nil, fmt.Errorf("mysocks5: no addresses found for %q", name)
+	}
+	return ctx, addrs[0].IP, nil
+}
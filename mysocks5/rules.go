@@ -0,0 +1,45 @@
+package mysocks5
+
+import "context"
+
+// RuleSet decides whether a given Request is permitted to proceed. Allow
+// may stash policy-decision context (e.g. which rule matched) on the
+// returned context.
+type RuleSet interface {
+	Allow(ctx context.Context, req *Request) (context.Context, bool)
+}
+
+// PermitAll is a RuleSet that allows every request
+type PermitAll struct{}
+
+func (p PermitAll) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, true
+}
+
+// PermitCommand is a RuleSet that gates each SOCKS5 command independently
+type PermitCommand struct {
+	EnableConnect   bool
+	EnableBind      bool
+	EnableAssociate bool
+}
+
+func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	switch req.Command {
+	case ConnectCommand:
+		return ctx, p.EnableConnect
+	case BindCommand:
+		return ctx, p.EnableBind
+	case AssociateCommand:
+		return ctx, p.EnableAssociate
+	}
+	return ctx, false
+}
+
+// AddressRewriter rewrites a request's destination address after
+// resolution and before rule evaluation, e.g. to redirect or mask
+// internal addresses. Returning a nil *AddrSpec vetoes the request
+// (handleRequest replies hostUnreachable and aborts) instead of
+// proceeding with no destination.
+type AddressRewriter interface {
+	Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec)
+}